@@ -0,0 +1,75 @@
+package manners
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitListener wraps l so that Accept blocks once max connections are
+// concurrently open, releasing a slot as each returned connection is
+// closed. This is the same pattern as golang.org/x/net/netutil.LimitListener
+// (and tylerb/graceful's limit_listen.go), used to cap how many clients a
+// server will serve at once.
+func LimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+// Accept blocks until a connection slot is available or the listener is
+// closed, so a graceful shutdown that closes the underlying listener also
+// unblocks any Accept call waiting here. On that path it defers to the
+// underlying Listener's own Accept to produce the error, so callers like
+// GracefulServer.Serve see the same listenerAlreadyClosed (or other) error
+// they'd get without a MaxConnections wrapper, rather than some distinct
+// sentinel they don't know to check for.
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return l.Listener.Accept()
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: l.release}, nil
+}
+
+func (l *limitListener) release() {
+	<-l.sem
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// limitListenerConn releases its limitListener's slot on the first call to
+// its Close; later calls do not release it again. A connection that is
+// never closed through this wrapper keeps its slot.
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
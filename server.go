@@ -48,6 +48,9 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
 // interface describing a waitgroup, so unit
@@ -66,6 +69,57 @@ type Options struct {
 	Server       *http.Server
 	StateHandler StateHandler
 	Listener     net.Listener
+
+	// HTTP2 enables automatic HTTP/2 (h2) ALPN negotiation on TLS listeners
+	// started via ListenAndServeTLS / ListenAndServeTLSWithConfig. Servers
+	// built with NewServer or NewWithServer enable this by default; because
+	// Options has no way to tell an unset bool from an explicit false, it
+	// must be set to true here to get the same behavior.
+	HTTP2 bool
+
+	// MaxConnections caps the number of concurrently open connections. Once
+	// reached, Accept blocks new clients until an existing connection
+	// closes. Zero means unlimited. Only Options.Listener is wrapped: a
+	// listener that ListenAndServe or ListenAndServeTLS creates, or one
+	// passed to Serve, is not limited.
+	MaxConnections int
+
+	// BeforeShutdown, if set, is called synchronously as soon as a shutdown
+	// is triggered, before the listener is closed. Use it to deregister
+	// from service discovery or flip a readiness probe to failing while
+	// there's still time for a load balancer to stop sending new traffic.
+	BeforeShutdown func()
+
+	// ShutdownInitiated, if set, is called after the listener is closed and
+	// new connections have stopped being accepted. Close, CloseWithTimeout
+	// and the pre-Go 1.8 Shutdown call it immediately after closing the
+	// listener; the Go 1.8+ Shutdown calls it only once
+	// http.Server.Shutdown has returned, after the drain has finished or
+	// its ctx is done.
+	ShutdownInitiated func()
+
+	// ConnState is a stdlib-style alternative to StateHandler, matching the
+	// signature of http.Server.ConnState so middleware written for the
+	// stdlib can be used without adapting it to the (old, new) two-state
+	// form StateHandler takes.
+	ConnState func(net.Conn, http.ConnState)
+
+	// ConnReadTimeout and ConnWriteTimeout, if non-zero, are applied to
+	// every accepted connection via SetReadDeadline/SetWriteDeadline, and
+	// refreshed each time the connection makes progress (accepted, starts
+	// a request, goes idle after one completes). They act as idle/progress
+	// timeouts rather than a cap on the connection's total lifetime: a
+	// keep-alive connection that keeps exchanging requests, however many
+	// and however long its open, never trips either one, but a client that
+	// never progresses past a TLS handshake, or that goes quiet between
+	// requests for longer than the configured duration, does - which is
+	// what keeps such connections from blocking a shutdown's wg.Wait()
+	// indefinitely. ConnWriteTimeout still bounds a single response's
+	// write the same way Server.WriteTimeout does, so a legitimately slow
+	// or large streamed response can still be cut off if it outlasts it;
+	// pick a value long enough to cover your slowest legitimate response.
+	ConnReadTimeout  time.Duration
+	ConnWriteTimeout time.Duration
 }
 
 // NewServer creates a new GracefulServer. The server will begin shutting down when
@@ -81,6 +135,7 @@ func NewWithServer(s *http.Server) *GracefulServer {
 		Server:   s,
 		shutdown: make(chan struct{}),
 		wg:       new(sync.WaitGroup),
+		http2:    true,
 	}
 }
 
@@ -88,20 +143,30 @@ func NewWithOptions(o Options) *GracefulServer {
 	// Set up listener
 	var listener *GracefulListener
 	if o.Listener != nil {
-		g, ok := o.Listener.(*GracefulListener)
+		l := o.Listener
+		if o.MaxConnections > 0 {
+			l = LimitListener(l, o.MaxConnections)
+		}
+		g, ok := l.(*GracefulListener)
 		if !ok {
-			listener = NewListener(o.Listener)
+			listener = NewListener(l)
 		} else {
 			listener = g
 		}
 	}
 
 	return &GracefulServer{
-		listener:     listener,
-		Server:       o.Server,
-		stateHandler: o.StateHandler,
-		shutdown:     make(chan struct{}),
-		wg:           new(sync.WaitGroup),
+		listener:          listener,
+		Server:            o.Server,
+		stateHandler:      o.StateHandler,
+		connState:         o.ConnState,
+		beforeShutdown:    o.BeforeShutdown,
+		shutdownInitiated: o.ShutdownInitiated,
+		connReadTimeout:   o.ConnReadTimeout,
+		connWriteTimeout:  o.ConnWriteTimeout,
+		shutdown:          make(chan struct{}),
+		wg:                new(sync.WaitGroup),
+		http2:             o.HTTP2,
 	}
 }
 
@@ -118,29 +183,150 @@ type GracefulServer struct {
 	*http.Server
 	shutdown chan struct{}
 	wg       waitgroup
-	listener *GracefulListener
+
+	listenerMu sync.Mutex
+	listener   *GracefulListener
 
 	// used by test code
 	up chan net.Listener
 
 	stateHandler StateHandler
+	connState    func(net.Conn, http.ConnState)
+
+	beforeShutdown    func()
+	shutdownInitiated func()
+
+	connReadTimeout  time.Duration
+	connWriteTimeout time.Duration
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	http2                 bool
+	shutdownOnce          sync.Once
+	shutdownInitiatedOnce sync.Once
+}
+
+// setListener records the listener Serve is about to accept on, guarded by
+// listenerMu since Serve can run on a different goroutine than the one that
+// later calls Close, CloseWithTimeout or Shutdown to stop it.
+func (s *GracefulServer) setListener(l *GracefulListener) {
+	s.listenerMu.Lock()
+	s.listener = l
+	s.listenerMu.Unlock()
+}
+
+// getListener returns the server's current listener, or nil if none has
+// been set yet (by NewWithOptions, HijackListener, ListenAndServe,
+// ListenAndServeTLSWithConfig or Serve). Guarded the same way as
+// setListener.
+func (s *GracefulServer) getListener() *GracefulListener {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	return s.listener
+}
+
+// closeListener closes the server's listener, if it has one, so that the
+// blocked Serve call can return. Safe to call even if the listener is nil
+// (e.g. Close was called before Serve). Callers that delegate the actual
+// close to the stdlib (the Go 1.8+ Shutdown) skip this and let
+// http.Server.Shutdown close it instead, so the listener is only ever
+// closed once.
+func (s *GracefulServer) closeListener() {
+	if l := s.getListener(); l != nil {
+		l.Close()
+	}
+}
+
+// initiateShutdown closes the shutdown channel and runs BeforeShutdown. It
+// is safe to call more than once, which Close, Shutdown and
+// CloseWithTimeout all may end up doing if combined; the work only happens
+// on the first call. It does not close the listener itself, since on Go
+// 1.8+ that's delegated to http.Server.Shutdown — see fireShutdownInitiated.
+func (s *GracefulServer) initiateShutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+		if s.beforeShutdown != nil {
+			s.beforeShutdown()
+		}
+	})
+}
+
+// fireShutdownInitiated runs ShutdownInitiated exactly once, to be called by
+// whichever shutdown path actually closed the listener.
+func (s *GracefulServer) fireShutdownInitiated() {
+	s.shutdownInitiatedOnce.Do(func() {
+		if s.shutdownInitiated != nil {
+			s.shutdownInitiated()
+		}
+	})
 }
 
-// Close stops the server from accepting new requets and beings shutting down.
+// Close stops the server from accepting new requests and begins shutting
+// down. It does not wait for in-flight requests or idle keep-alive
+// connections to finish draining; use Shutdown or CloseWithTimeout for
+// that.
 func (s *GracefulServer) Close() {
-	close(s.shutdown)
+	s.initiateShutdown()
+	s.closeListener()
+	s.fireShutdownInitiated()
+}
+
+// CloseWithTimeout stops the server the same way Close does, but does not
+// wait indefinitely for in-flight requests and idle keep-alive connections
+// to drain. If they have not finished within d, every tracked connection is
+// force-closed so that the blocked Serve call can return.
+func (s *GracefulServer) CloseWithTimeout(d time.Duration) error {
+	s.initiateShutdown()
+	s.closeListener()
+	s.fireShutdownInitiated()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(d):
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		return nil
+	}
+}
+
+func (s *GracefulServer) trackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.connsMu.Unlock()
+}
+
+func (s *GracefulServer) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
 }
 
 // ListenAndServe provides a graceful equivalent of net/http.Serve.ListenAndServe.
 func (s *GracefulServer) ListenAndServe() error {
-	if s.listener == nil {
+	listener := s.getListener()
+	if listener == nil {
 		oldListener, err := net.Listen("tcp", s.Addr)
 		if err != nil {
 			return err
 		}
-		s.listener = NewListener(oldListener.(*net.TCPListener))
+		listener = NewListener(oldListener.(*net.TCPListener))
+		s.setListener(listener)
 	}
-	return s.Serve(s.listener)
+	return s.Serve(listener)
 }
 
 // ListenAndServeTLS provides a graceful equivalent of net/http.Serve.ListenAndServeTLS.
@@ -168,30 +354,55 @@ func (s *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 }
 
 // ListenAndServeTLS provides a graceful equivalent of net/http.Serve.ListenAndServeTLS.
+//
+// Automatic HTTP/2 ALPN negotiation (see the HTTP2 option) only takes
+// effect for the listener this method creates, i.e. when s.listener is
+// nil when it's called: config's NextProtos is what gets offered during
+// the handshake, and config is only wired into a listener right here.
+// If a listener was already supplied (via Options.Listener, HijackListener
+// or a prior call to Serve), this config is never used for its handshakes,
+// so "h2" must already be part of whatever TLS config that listener was
+// built with.
 func (s *GracefulServer) ListenAndServeTLSWithConfig(config *tls.Config) error {
 	addr := s.Addr
 	if addr == "" {
 		addr = ":https"
 	}
 
-	if s.listener == nil {
+	if config.NextProtos == nil {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	// Only configure h2 if the caller hasn't already populated TLSNextProto
+	// themselves (e.g. with their own "h2" handler) and HTTP2 wasn't
+	// disabled.
+	if s.http2 && s.Server.TLSNextProto == nil {
+		if err := http2.ConfigureServer(s.Server, &http2.Server{}); err != nil {
+			return err
+		}
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	}
+
+	listener := s.getListener()
+	if listener == nil {
 		ln, err := net.Listen("tcp", addr)
 		if err != nil {
 			return err
 		}
 
 		tlsListener := NewTLSListener(TCPKeepAliveListener{ln.(*net.TCPListener)}, config)
-		s.listener = NewListener(tlsListener)
+		listener = NewListener(tlsListener)
+		s.setListener(listener)
 	}
-	return s.Serve(s.listener)
+	return s.Serve(listener)
 }
 
 func (gs *GracefulServer) GetFile() (*os.File, error) {
-	return gs.listener.GetFile()
+	return gs.getListener().GetFile()
 }
 
 func (gs *GracefulServer) HijackListener(s *http.Server, config *tls.Config) (*GracefulServer, error) {
-	listener, err := gs.listener.Clone()
+	listener, err := gs.getListener().Clone()
 	if err != nil {
 		return nil, err
 	}
@@ -201,7 +412,7 @@ func (gs *GracefulServer) HijackListener(s *http.Server, config *tls.Config) (*G
 	}
 
 	other := NewWithServer(s)
-	other.listener = NewListener(listener)
+	other.setListener(NewListener(listener))
 	return other, nil
 }
 
@@ -218,30 +429,52 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 		gracefulListener = NewListener(listener)
 		listener = gracefulListener
 	}
-	s.listener = gracefulListener
+	s.setListener(gracefulListener)
 
 	// Wrap the server HTTP handler into graceful one. It will reject requests
 	// received via kept alive connections with 503 Service Unavailable if they
 	// are received after the server is closed.
-	gracefulHandler := newGracefulHandler(s.Server.Handler)
+	gracefulHandler := newGracefulHandler(s, s.Server.Handler)
 	s.Server.Handler = gracefulHandler
 
-	// Start a goroutine that waits for a shutdown signal and will stop the
-	// listener when it receives the signal. That in turn will result in
-	// unblocking of the http.Serve call.
-	go func() {
-		<-s.shutdown
+	// Shutdown may already have been requested before Serve was even
+	// called (e.g. Close() racing a slow caller). Close, CloseWithTimeout
+	// and Shutdown each close the listener themselves (or, on Go 1.8+
+	// Shutdown, delegate that to http.Server.Shutdown) as soon as they
+	// run, against whatever listener existed at the time — which was nil.
+	// Close the listener we just created here to cover that race; the
+	// BeforeShutdown/ShutdownInitiated hooks already ran from whichever
+	// method requested the shutdown.
+	select {
+	case <-s.shutdown:
 		gracefulListener.Close()
-	}()
+	default:
+	}
 
 	orgConnState := s.Server.ConnState
 	s.ConnState = func(conn net.Conn, newState http.ConnState) {
 		gracefulConn := retrieveGracefulConn(conn)
 		oldState := gracefulConn.lastHTTPState
 		gracefulConn.lastHTTPState = newState
+
 		switch newState {
 		case http.StateNew:
 			// new_conn -> StateNew
+
+			// Ideally these deadlines would be set once in
+			// GracefulListener.Accept, but that listener isn't part of
+			// this source tree, so they're set here instead, the first
+			// time we see the connection. They're refreshed again below
+			// on every later transition, so this first arming only needs
+			// to cover the time up to the connection's first request.
+			if s.connReadTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.connReadTimeout))
+			}
+			if s.connWriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(s.connWriteTimeout))
+			}
+
+			s.trackConn(conn)
 			s.StartRoutine()
 
 		case http.StateActive:
@@ -255,12 +488,36 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 				}
 			}
 
+			// Refresh both deadlines for every request on the
+			// connection, not just the first: this is what makes them
+			// idle/progress timeouts rather than a one-shot check at
+			// accept time. A connection that keeps making progress -
+			// finishing requests and receiving new ones - never trips
+			// either deadline no matter how long it stays open overall.
+			// ConnWriteTimeout still has to cover this one request's
+			// response in full, the same way Server.WriteTimeout does.
+			if s.connReadTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.connReadTimeout))
+			}
+			if s.connWriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(s.connWriteTimeout))
+			}
+
 		case http.StateIdle:
 			// StateActive -> StateIdle
 			s.FinishRoutine()
 
+			// Only the read deadline matters while idle - nothing is
+			// being written - and refreshing it here is what bounds how
+			// long a keep-alive connection can sit between requests
+			// before it's considered abandoned.
+			if s.connReadTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.connReadTimeout))
+			}
+
 		case http.StateClosed, http.StateHijacked:
 			// (StateNew, StateActive, StateIdle) -> (StateClosed, StateHiJacked)
+			s.untrackConn(conn)
 			if oldState != http.StateIdle && !gracefulConn.forceClosed {
 				s.FinishRoutine()
 			}
@@ -270,6 +527,10 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 			s.stateHandler(conn, oldState, newState)
 		}
 
+		if s.connState != nil {
+			s.connState(conn, newState)
+		}
+
 		if orgConnState != nil {
 			orgConnState(conn, newState)
 		}
@@ -341,11 +602,30 @@ func Serve(l net.Listener, handler http.Handler) error {
 // Close triggers a shutdown of all running Graceful servers.
 func Close() {
 	m.Lock()
-	for _, s := range servers {
+	current := servers
+	servers = nil
+	m.Unlock()
+
+	for _, s := range current {
 		s.Close()
 	}
+}
+
+// CloseWithTimeout triggers a shutdown of all running Graceful servers,
+// bounding how long each will wait for in-flight requests and idle
+// keep-alive connections to drain before forcing its connections closed.
+func CloseWithTimeout(d time.Duration) error {
+	m.Lock()
+	current := servers
 	servers = nil
 	m.Unlock()
+
+	for _, s := range current {
+		if err := s.CloseWithTimeout(d); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // gracefulHandler is used by GracefulServer to prevent calling ServeHTTP on
@@ -353,16 +633,26 @@ func Close() {
 type gracefulHandler struct {
 	closed  int32 // accessed atomically.
 	wrapped http.Handler
+	server  *GracefulServer
 }
 
-func newGracefulHandler(wrapped http.Handler) *gracefulHandler {
+func newGracefulHandler(s *GracefulServer, wrapped http.Handler) *gracefulHandler {
 	return &gracefulHandler{
 		wrapped: wrapped,
+		server:  s,
 	}
 }
 
 func (gh *gracefulHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if atomic.LoadInt32(&gh.closed) == 0 {
+		if r.ProtoMajor >= 2 {
+			// HTTP/2 multiplexes many requests over a single net.Conn, so
+			// ConnState never transitions per-request the way it does for
+			// HTTP/1.x keep-alive connections. Count each stream directly
+			// instead of relying on the ConnState-driven bookkeeping in Serve.
+			gh.server.StartRoutine()
+			defer gh.server.FinishRoutine()
+		}
 		gh.wrapped.ServeHTTP(w, r)
 		return
 	}
@@ -0,0 +1,43 @@
+//go:build go1.8
+// +build go1.8
+
+package manners
+
+import "context"
+
+// Shutdown gracefully shuts down the server without interrupting any
+// in-flight requests. It delegates closing the listener and draining idle
+// keep-alive connections and in-progress requests to the stdlib's
+// http.Server.Shutdown, which understands both far better than the
+// ConnState-driven bookkeeping this package used before Go 1.8 added it.
+// That bookkeeping (gracefulHandler, the ConnState state machine) stays in
+// place alongside it, though: CloseWithTimeout's connection tracking, the
+// HTTP/2 request counting and the StartRoutine/FinishRoutine accounting
+// for user goroutines all still depend on it, so after the stdlib's drain
+// this also waits for s.wg, bailing out early if ctx is done first.
+// ShutdownInitiated runs once http.Server.Shutdown has returned, that is
+// after the drain has finished or ctx is done. http.Server.Shutdown
+// already closes the listener itself, so this deliberately does not also
+// call closeListener — doing both would race to close the same listener
+// twice, and the stdlib's own Shutdown would return the resulting "already
+// closed" error even though shutdown was perfectly clean.
+func (s *GracefulServer) Shutdown(ctx context.Context) error {
+	s.initiateShutdown()
+	err := s.Server.Shutdown(ctx)
+	s.fireShutdownInitiated()
+
+	wgDone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(wgDone)
+	}()
+
+	select {
+	case <-wgDone:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
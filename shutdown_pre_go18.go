@@ -0,0 +1,30 @@
+//go:build !go1.8
+// +build !go1.8
+
+package manners
+
+import "context"
+
+// Shutdown gracefully shuts down the server without interrupting any
+// in-flight requests. http.Server.Shutdown doesn't exist before Go 1.8, so
+// this falls back to closing the listener directly, the same way Close
+// does, so Accept stops, and then, unlike Close, waits for s.wg to drain,
+// bailing out early if ctx is done first.
+func (s *GracefulServer) Shutdown(ctx context.Context) error {
+	s.initiateShutdown()
+	s.closeListener()
+	s.fireShutdownInitiated()
+
+	wgDone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(wgDone)
+	}()
+
+	select {
+	case <-wgDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}